@@ -0,0 +1,185 @@
+// Package accesslog provides a pluggable, structured access log for the
+// proxy: one JSON (or text) line per request, written to stdout or a
+// rotating file, with optional sampling for high-volume traffic.
+package accesslog
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Entry is the set of fields recorded for a single proxied request. A
+// request produces exactly one Entry, correlated by RequestID, rather
+// than the several uncorrelated log lines the proxy used to emit.
+type Entry struct {
+	Time            time.Time     `json:"time"`
+	Method          string        `json:"method"`
+	Path            string        `json:"path"`
+	RealIP          string        `json:"real_ip"`
+	Upstream        string        `json:"upstream,omitempty"`
+	UpstreamLatency time.Duration `json:"-"`
+	ResponseSize    int64         `json:"response_size"`
+	Status          int           `json:"status"`
+	RequestID       string        `json:"request_id"`
+	UserAgent       string        `json:"user_agent,omitempty"`
+	Route           string        `json:"route,omitempty"`
+}
+
+// entryJSON mirrors Entry for JSON output, swapping UpstreamLatency (a
+// time.Duration, which has no natural JSON representation) for a plain
+// millisecond float so the upstream latency actually appears in the log.
+type entryJSON struct {
+	Time              time.Time `json:"time"`
+	Method            string    `json:"method"`
+	Path              string    `json:"path"`
+	RealIP            string    `json:"real_ip"`
+	Upstream          string    `json:"upstream,omitempty"`
+	UpstreamLatencyMS float64   `json:"upstream_latency_ms"`
+	ResponseSize      int64     `json:"response_size"`
+	Status            int       `json:"status"`
+	RequestID         string    `json:"request_id"`
+	UserAgent         string    `json:"user_agent,omitempty"`
+	Route             string    `json:"route,omitempty"`
+}
+
+// MarshalJSON renders UpstreamLatency in milliseconds instead of dropping it.
+func (e Entry) MarshalJSON() ([]byte, error) {
+	return json.Marshal(entryJSON{
+		Time:              e.Time,
+		Method:            e.Method,
+		Path:              e.Path,
+		RealIP:            e.RealIP,
+		Upstream:          e.Upstream,
+		UpstreamLatencyMS: float64(e.UpstreamLatency) / float64(time.Millisecond),
+		ResponseSize:      e.ResponseSize,
+		Status:            e.Status,
+		RequestID:         e.RequestID,
+		UserAgent:         e.UserAgent,
+		Route:             e.Route,
+	})
+}
+
+// Format selects how entries are rendered.
+type Format string
+
+const (
+	FormatJSON Format = "json"
+	FormatText Format = "text"
+)
+
+// Logger writes access log Entries in the configured Format, optionally
+// sampling a fraction of them.
+type Logger struct {
+	out        io.Writer
+	format     Format
+	sampleRate float64
+
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+// New creates a Logger writing to out, rendering entries as format, and
+// logging a sampleRate fraction of calls to Log (1.0 logs everything).
+func New(out io.Writer, format Format, sampleRate float64) *Logger {
+	if format != FormatText {
+		format = FormatJSON
+	}
+	if sampleRate <= 0 || sampleRate > 1 {
+		sampleRate = 1
+	}
+	return &Logger{
+		out:        out,
+		format:     format,
+		sampleRate: sampleRate,
+		rng:        rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// NewFromEnv builds a Logger from LOG_FORMAT (json|text, default json),
+// LOG_FILE (path to a rotating log file; defaults to stdout),
+// LOG_MAX_MB/LOG_MAX_BACKUPS (rotation size and retention), and
+// LOG_SAMPLE_RATE (0.0-1.0, default 1.0).
+func NewFromEnv() (*Logger, error) {
+	format := Format(os.Getenv("LOG_FORMAT"))
+	if format == "" {
+		format = FormatJSON
+	}
+
+	sampleRate := 1.0
+	if v := os.Getenv("LOG_SAMPLE_RATE"); v != "" {
+		parsed, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LOG_SAMPLE_RATE: %w", err)
+		}
+		sampleRate = parsed
+	}
+
+	var out io.Writer = os.Stdout
+	if path := os.Getenv("LOG_FILE"); path != "" {
+		maxMB := 100
+		if v := os.Getenv("LOG_MAX_MB"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid LOG_MAX_MB: %w", err)
+			}
+			maxMB = n
+		}
+		maxBackups := 5
+		if v := os.Getenv("LOG_MAX_BACKUPS"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid LOG_MAX_BACKUPS: %w", err)
+			}
+			maxBackups = n
+		}
+		rw, err := newRotatingWriter(path, maxMB, maxBackups)
+		if err != nil {
+			return nil, err
+		}
+		out = rw
+	}
+
+	return New(out, format, sampleRate), nil
+}
+
+// Log renders and writes e, subject to the logger's sample rate. Sampling
+// is skipped (the entry is always written) for non-2xx responses, since
+// those are the ones operators most want to see.
+func (l *Logger) Log(e Entry) {
+	if l.sampleRate < 1 && e.Status < 400 {
+		l.mu.Lock()
+		skip := l.rng.Float64() >= l.sampleRate
+		l.mu.Unlock()
+		if skip {
+			return
+		}
+	}
+
+	var line string
+	if l.format == FormatText {
+		line = e.textLine()
+	} else {
+		data, err := json.Marshal(e)
+		if err != nil {
+			line = fmt.Sprintf(`{"request_id":%q,"marshal_error":%q}`, e.RequestID, err.Error())
+		} else {
+			line = string(data)
+		}
+	}
+
+	l.mu.Lock()
+	fmt.Fprintln(l.out, line)
+	l.mu.Unlock()
+}
+
+func (e Entry) textLine() string {
+	return fmt.Sprintf("%s %s %s ip=%s upstream=%s route=%s status=%d size=%d latency=%s request_id=%s ua=%q",
+		e.Time.Format(time.RFC3339), e.Method, e.Path, e.RealIP, e.Upstream, e.Route,
+		e.Status, e.ResponseSize, e.UpstreamLatency, e.RequestID, e.UserAgent)
+}
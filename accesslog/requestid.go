@@ -0,0 +1,45 @@
+package accesslog
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+// crockford is the Crockford base32 alphabet ULIDs use (no I, L, O, U, to
+// avoid transcription mistakes).
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewRequestID returns a 26-character ULID-style identifier: a 48-bit
+// millisecond timestamp followed by 80 bits of random entropy, both
+// Crockford base32 encoded, so IDs sort lexicographically by creation
+// time without needing an external ULID library.
+func NewRequestID(unixMilli int64) string {
+	var data [16]byte
+	binary.BigEndian.PutUint16(data[0:2], uint16(unixMilli>>32))
+	binary.BigEndian.PutUint32(data[2:6], uint32(unixMilli))
+	rand.Read(data[6:16])
+
+	return encodeCrockford(data)
+}
+
+// encodeCrockford renders 16 bytes (128 bits) as 26 base32 characters.
+func encodeCrockford(data [16]byte) string {
+	var out [26]byte
+	var buf uint64
+	bits := 0
+	pos := 0
+	for _, b := range data {
+		buf = buf<<8 | uint64(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockford[(buf>>uint(bits))&0x1f]
+			pos++
+		}
+	}
+	if bits > 0 {
+		out[pos] = crockford[(buf<<uint(5-bits))&0x1f]
+		pos++
+	}
+	return string(out[:pos])
+}
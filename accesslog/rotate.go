@@ -0,0 +1,100 @@
+package accesslog
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatingWriter is a minimal size-based rotating file writer: once the
+// current file exceeds maxBytes, it's renamed with a timestamp suffix and
+// a fresh file is opened in its place. Only the maxBackups most recent
+// rotated files are kept.
+type rotatingWriter struct {
+	mu         sync.Mutex
+	path       string
+	maxBytes   int64
+	maxBackups int
+
+	file    *os.File
+	written int64
+}
+
+func newRotatingWriter(path string, maxMB, maxBackups int) (*rotatingWriter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &rotatingWriter{
+		path:       path,
+		maxBytes:   int64(maxMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		file:       f,
+		written:    info.Size(),
+	}, nil
+}
+
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.maxBytes > 0 && w.written+int64(len(p)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *rotatingWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	rotated := fmt.Sprintf("%s.%s", w.path, time.Now().UTC().Format("20060102T150405.000000000"))
+	if err := os.Rename(w.path, rotated); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(w.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	w.file = f
+	w.written = 0
+	return w.pruneBackups()
+}
+
+// pruneBackups removes the oldest rotated backups beyond maxBackups.
+func (w *rotatingWriter) pruneBackups() error {
+	if w.maxBackups <= 0 {
+		return nil
+	}
+	dir := filepath.Dir(w.path)
+	base := filepath.Base(w.path)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasPrefix(e.Name(), base+".") {
+			backups = append(backups, filepath.Join(dir, e.Name()))
+		}
+	}
+	sort.Strings(backups) // timestamp suffix sorts chronologically
+	for len(backups) > w.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// cidrEntry is one parsed CIDR/IP entry, pre-expanded to its 16-byte
+// (IPv4-in-IPv6 for v4 addresses) start/end range so membership checks
+// never need to re-derive the mask.
+type cidrEntry struct {
+	raw     string
+	network *net.IPNet
+	start   []byte
+	end     []byte
+}
+
+// cidrSet is a set of CIDR ranges. Membership checks scan every range
+// rather than binary-searching on range start: ACL lists routinely
+// contain overlapping/nested CIDRs (e.g. a blacklist of both 10.0.0.0/8
+// and 10.1.0.0/16), and a binary search keyed on start alone only finds
+// the nearest-preceding range, silently missing an enclosing one.
+// Correctness matters more than O(log n) here.
+type cidrSet struct {
+	entries []cidrEntry
+}
+
+// newCIDRSet parses a list of CIDR blocks or bare IPs (treated as /32 or
+// /128) into a sorted cidrSet.
+func newCIDRSet(items []string) (*cidrSet, error) {
+	set := &cidrSet{}
+	for _, raw := range items {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if !strings.Contains(raw, "/") {
+			ip := net.ParseIP(raw)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP or CIDR: %q", raw)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			raw = fmt.Sprintf("%s/%d", raw, bits)
+		}
+		_, network, err := net.ParseCIDR(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q: %w", raw, err)
+		}
+
+		start := network.IP.To16()
+		mask := to16Mask(network.Mask)
+		end := make([]byte, 16)
+		for i := range end {
+			end[i] = start[i] | ^mask[i]
+		}
+		set.entries = append(set.entries, cidrEntry{raw: raw, network: network, start: start, end: end})
+	}
+	sort.Slice(set.entries, func(i, j int) bool {
+		return bytes.Compare(set.entries[i].start, set.entries[j].start) < 0
+	})
+	return set, nil
+}
+
+// to16Mask widens a 4-byte IPv4 mask to its 16-byte IPv4-in-IPv6 form so
+// it can be compared/combined byte-for-byte with To16() addresses.
+func to16Mask(mask net.IPMask) []byte {
+	if len(mask) == 16 {
+		return mask
+	}
+	full := make([]byte, 16)
+	for i := 0; i < 12; i++ {
+		full[i] = 0xff
+	}
+	copy(full[12:], mask)
+	return full
+}
+
+// Empty reports whether the set has no ranges configured, the case in
+// which callers typically treat a check against it as "everything
+// allowed" rather than "nothing allowed" (see forwardedConfig.trusted and
+// connectAllowlist.allowed).
+func (s *cidrSet) Empty() bool {
+	return s == nil || len(s.entries) == 0
+}
+
+// Contains reports whether ip falls within any range in the set, and if
+// so, the string form of the matching CIDR (useful for per-rule metrics).
+// Every range is checked, so overlapping/nested CIDRs are all considered,
+// not just the one with the nearest-preceding start.
+func (s *cidrSet) Contains(ip net.IP) (bool, string) {
+	if s == nil || len(s.entries) == 0 {
+		return false, ""
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return false, ""
+	}
+	for _, entry := range s.entries {
+		if bytes.Compare(ip16, entry.start) >= 0 && bytes.Compare(ip16, entry.end) <= 0 {
+			return true, entry.raw
+		}
+	}
+	return false, ""
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+// TestCIDRSetContainsNestedAndOverlapping guards against the bug fixed in
+// commit 7e6a1a2: an earlier binary-search Contains keyed on range start
+// found only the nearest-preceding range, silently missing a CIDR that
+// encloses (or overlaps) the one actually nearest the query IP.
+func TestCIDRSetContainsNestedAndOverlapping(t *testing.T) {
+	set, err := newCIDRSet([]string{"10.0.0.0/8", "10.1.0.0/16", "10.1.2.0/24", "192.168.1.1"})
+	if err != nil {
+		t.Fatalf("newCIDRSet: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		ip       string
+		wantOK   bool
+		wantRule string
+	}{
+		{"inside every nested range, widest-start rule reported first", "10.1.2.5", true, "10.0.0.0/8"},
+		{"inside middle and outer range", "10.1.5.5", true, "10.0.0.0/8"},
+		{"inside outermost range only", "10.2.0.1", true, "10.0.0.0/8"},
+		{"bare IP entry treated as /32", "192.168.1.1", true, "192.168.1.1/32"},
+		{"outside every range", "8.8.8.8", false, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := mustParseIP(t, tt.ip)
+			ok, rule := set.Contains(ip)
+			if ok != tt.wantOK {
+				t.Fatalf("Contains(%s) ok = %v, want %v", tt.ip, ok, tt.wantOK)
+			}
+			if ok && rule != tt.wantRule {
+				t.Errorf("Contains(%s) rule = %q, want %q", tt.ip, rule, tt.wantRule)
+			}
+		})
+	}
+}
+
+// TestCIDRSetContainsDoesNotStopAtNearestPrecedingRange is a narrower
+// regression case for the same bug: a range whose start sorts before an
+// enclosing range's start must still be found when the enclosing range is
+// the one that actually matches.
+func TestCIDRSetContainsDoesNotStopAtNearestPrecedingRange(t *testing.T) {
+	set, err := newCIDRSet([]string{"10.0.0.0/24", "10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("newCIDRSet: %v", err)
+	}
+
+	ok, rule := set.Contains(mustParseIP(t, "10.5.5.5"))
+	if !ok {
+		t.Fatal("Contains(10.5.5.5) = false, want true (should match the enclosing /8)")
+	}
+	if rule != "10.0.0.0/8" {
+		t.Errorf("Contains(10.5.5.5) rule = %q, want %q", rule, "10.0.0.0/8")
+	}
+}
+
+func TestCIDRSetContainsEmpty(t *testing.T) {
+	set, err := newCIDRSet(nil)
+	if err != nil {
+		t.Fatalf("newCIDRSet: %v", err)
+	}
+	if ok, rule := set.Contains(mustParseIP(t, "1.2.3.4")); ok || rule != "" {
+		t.Errorf("Contains on empty set = (%v, %q), want (false, \"\")", ok, rule)
+	}
+}
+
+func TestNewCIDRSetInvalidEntry(t *testing.T) {
+	if _, err := newCIDRSet([]string{"not-an-ip"}); err == nil {
+		t.Error("newCIDRSet with invalid entry: got nil error, want error")
+	}
+}
+
+func mustParseIP(t *testing.T, s string) net.IP {
+	t.Helper()
+	ip := net.ParseIP(s)
+	if ip == nil {
+		t.Fatalf("net.ParseIP(%q) failed", s)
+	}
+	return ip
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ipFilterMode selects how the whitelist and blacklist interact.
+type ipFilterMode string
+
+const (
+	// FilterWhitelistOnly allows only whitelisted IPs; everything else is denied.
+	FilterWhitelistOnly ipFilterMode = "whitelist_only"
+	// FilterBlacklistOnly denies only blacklisted IPs; everything else is allowed.
+	FilterBlacklistOnly ipFilterMode = "blacklist_only"
+	// FilterWhitelistFirst checks the whitelist first (always allow on a
+	// hit), then falls back to the blacklist for everyone else.
+	FilterWhitelistFirst ipFilterMode = "whitelist_first"
+	// FilterAuthBypass behaves like FilterBlacklistOnly, except a request
+	// carrying a valid auth key header bypasses filtering entirely.
+	FilterAuthBypass ipFilterMode = "auth_bypass"
+)
+
+// ipFilterConfig is the active configuration for the IP filter middleware.
+// It's held behind an atomic.Value so FILTER_FILE can be re-read on SIGHUP
+// without locking every request.
+type ipFilterConfig struct {
+	Mode          ipFilterMode
+	Whitelist     *cidrSet
+	Blacklist     *cidrSet
+	AuthKeyHeader string
+	AuthKeyValue  string
+	WarningPage   []byte
+}
+
+// filterFileConfig is the optional FILTER_FILE JSON document; its lists
+// are merged with WHITELIST_IPS/BLACKLIST_IPS.
+type filterFileConfig struct {
+	Whitelist []string `json:"whitelist"`
+	Blacklist []string `json:"blacklist"`
+}
+
+// filterMetrics holds allowed/denied counters per matching rule (the CIDR
+// string, or "default" when no specific rule matched).
+type filterMetrics struct {
+	mu      sync.Mutex
+	allowed map[string]*atomic.Uint64
+	denied  map[string]*atomic.Uint64
+}
+
+func newFilterMetrics() *filterMetrics {
+	return &filterMetrics{
+		allowed: make(map[string]*atomic.Uint64),
+		denied:  make(map[string]*atomic.Uint64),
+	}
+}
+
+func (m *filterMetrics) record(bucket map[string]*atomic.Uint64, rule string) {
+	m.mu.Lock()
+	counter, ok := bucket[rule]
+	if !ok {
+		counter = &atomic.Uint64{}
+		bucket[rule] = counter
+	}
+	m.mu.Unlock()
+	counter.Add(1)
+}
+
+func (m *filterMetrics) recordAllowed(rule string) { m.record(m.allowed, rule) }
+func (m *filterMetrics) recordDenied(rule string)  { m.record(m.denied, rule) }
+
+var defaultFilterMetrics = newFilterMetrics()
+
+const defaultFilterWarningPage = `<!DOCTYPE html>
+<html><head><title>403 Forbidden</title></head>
+<body><h1>403 Forbidden</h1><p>Your IP address is not permitted to access this resource.</p></body>
+</html>`
+
+// loadIPFilterConfig reads WHITELIST_IPS, BLACKLIST_IPS, FILTER_MODE,
+// FILTER_FILE, FILTER_WARNING_PAGE, AUTH_BYPASS_HEADER and AUTH_BYPASS_KEY
+// from the environment and FILTER_FILE (if set).
+func loadIPFilterConfig() (*ipFilterConfig, error) {
+	cfg := &ipFilterConfig{
+		Mode:          ipFilterMode(strings.ToLower(strings.TrimSpace(os.Getenv("FILTER_MODE")))),
+		AuthKeyHeader: os.Getenv("AUTH_BYPASS_HEADER"),
+		AuthKeyValue:  os.Getenv("AUTH_BYPASS_KEY"),
+		WarningPage:   []byte(defaultFilterWarningPage),
+	}
+	switch cfg.Mode {
+	case FilterWhitelistOnly, FilterBlacklistOnly, FilterWhitelistFirst, FilterAuthBypass:
+	default:
+		cfg.Mode = FilterBlacklistOnly
+	}
+
+	var whitelist, blacklist []string
+	if v := os.Getenv("WHITELIST_IPS"); v != "" {
+		whitelist = append(whitelist, strings.Split(v, ",")...)
+	}
+	if v := os.Getenv("BLACKLIST_IPS"); v != "" {
+		blacklist = append(blacklist, strings.Split(v, ",")...)
+	}
+
+	if path := os.Getenv("FILTER_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fileCfg filterFileConfig
+		if err := json.Unmarshal(data, &fileCfg); err != nil {
+			return nil, err
+		}
+		whitelist = append(whitelist, fileCfg.Whitelist...)
+		blacklist = append(blacklist, fileCfg.Blacklist...)
+	}
+
+	var err error
+	cfg.Whitelist, err = newCIDRSet(whitelist)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Blacklist, err = newCIDRSet(blacklist)
+	if err != nil {
+		return nil, err
+	}
+
+	if path := os.Getenv("FILTER_WARNING_PAGE"); path != "" {
+		page, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.WarningPage = page
+	}
+	return cfg, nil
+}
+
+// allow decides whether ip is permitted under the configured mode,
+// returning the matching rule (for metrics) alongside the verdict.
+func (c *ipFilterConfig) allow(ip string, authHeader string) (bool, string) {
+	if c.Mode == FilterAuthBypass && c.AuthKeyHeader != "" && c.AuthKeyValue != "" && subtle.ConstantTimeCompare([]byte(authHeader), []byte(c.AuthKeyValue)) == 1 {
+		return true, "auth_bypass"
+	}
+
+	parsed := parseIPOrHost(ip)
+	switch c.Mode {
+	case FilterWhitelistOnly:
+		if ok, rule := c.Whitelist.Contains(parsed); ok {
+			return true, rule
+		}
+		return false, "default"
+	case FilterWhitelistFirst:
+		if ok, rule := c.Whitelist.Contains(parsed); ok {
+			return true, rule
+		}
+		if ok, rule := c.Blacklist.Contains(parsed); ok {
+			return false, rule
+		}
+		return true, "default"
+	default: // FilterBlacklistOnly and FilterAuthBypass (once past the bypass check above)
+		if ok, rule := c.Blacklist.Contains(parsed); ok {
+			return false, rule
+		}
+		return true, "default"
+	}
+}
+
+// ipFilterMiddleware enforces the whitelist/blacklist rules in cfgHolder
+// against the real client IP (as computed by getRealIP, honoring
+// TRUSTED_PROXIES) for every request that reaches it. It sits between
+// logMiddleware and the proxy handler.
+func ipFilterMiddleware(next http.Handler, cfgHolder *atomic.Value, fwdCfg forwardedConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cfg := cfgHolder.Load().(*ipFilterConfig)
+		realIP := getRealIP(r, fwdCfg)
+
+		ok, rule := cfg.allow(realIP, r.Header.Get(cfg.AuthKeyHeader))
+		if ok {
+			defaultFilterMetrics.recordAllowed(rule)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		defaultFilterMetrics.recordDenied(rule)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write(cfg.WarningPage)
+	})
+}
+
+// parseIPOrHost extracts a net.IP from a bare IP string, tolerating a
+// trailing ":port" the way getRealIP's callers sometimes pass it through.
+func parseIPOrHost(s string) net.IP {
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		return net.ParseIP(host)
+	}
+	return nil
+}
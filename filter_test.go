@@ -0,0 +1,116 @@
+package main
+
+import "testing"
+
+func newTestFilterConfig(t *testing.T, mode ipFilterMode, whitelist, blacklist []string) *ipFilterConfig {
+	t.Helper()
+	wl, err := newCIDRSet(whitelist)
+	if err != nil {
+		t.Fatalf("newCIDRSet(whitelist): %v", err)
+	}
+	bl, err := newCIDRSet(blacklist)
+	if err != nil {
+		t.Fatalf("newCIDRSet(blacklist): %v", err)
+	}
+	return &ipFilterConfig{Mode: mode, Whitelist: wl, Blacklist: bl}
+}
+
+func TestIPFilterConfigAllowModes(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ipFilterConfig
+		ip   string
+		want bool
+	}{
+		{"whitelist_only allows listed", newTestFilterConfig(t, FilterWhitelistOnly, []string{"10.0.0.0/8"}, nil), "10.1.2.3", true},
+		{"whitelist_only denies unlisted", newTestFilterConfig(t, FilterWhitelistOnly, []string{"10.0.0.0/8"}, nil), "8.8.8.8", false},
+		{"blacklist_only denies listed", newTestFilterConfig(t, FilterBlacklistOnly, nil, []string{"10.0.0.0/8"}), "10.1.2.3", false},
+		{"blacklist_only allows unlisted", newTestFilterConfig(t, FilterBlacklistOnly, nil, []string{"10.0.0.0/8"}), "8.8.8.8", true},
+		{"whitelist_first prefers whitelist hit", newTestFilterConfig(t, FilterWhitelistFirst, []string{"10.0.0.0/8"}, []string{"10.0.0.0/8"}), "10.1.2.3", true},
+		{"whitelist_first falls back to blacklist", newTestFilterConfig(t, FilterWhitelistFirst, []string{"192.168.0.0/16"}, []string{"10.0.0.0/8"}), "10.1.2.3", false},
+		{"whitelist_first allows default", newTestFilterConfig(t, FilterWhitelistFirst, []string{"192.168.0.0/16"}, []string{"10.0.0.0/8"}), "8.8.8.8", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _ := tt.cfg.allow(tt.ip, "")
+			if ok != tt.want {
+				t.Errorf("allow(%q) = %v, want %v", tt.ip, ok, tt.want)
+			}
+		})
+	}
+}
+
+// TestIPFilterConfigAuthBypass guards the auth-bypass comparison itself:
+// a matching key must bypass filtering, and - since the comparison now
+// goes through subtle.ConstantTimeCompare - keys of differing length or
+// differing content must still compare unequal rather than panicking or
+// short-circuiting.
+func TestIPFilterConfigAuthBypass(t *testing.T) {
+	cfg := newTestFilterConfig(t, FilterAuthBypass, nil, []string{"10.0.0.0/8"})
+	cfg.AuthKeyHeader = "X-Auth-Key"
+	cfg.AuthKeyValue = "s3cr3t-key"
+
+	tests := []struct {
+		name   string
+		header string
+		want   bool
+	}{
+		{"correct key bypasses blacklist", "s3cr3t-key", true},
+		{"wrong key of same length is denied", "s3cr3t-kex", false},
+		{"shorter key is denied", "s3cr3t", false},
+		{"longer key is denied", "s3cr3t-key-extra", false},
+		{"empty key is denied", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok, _ := cfg.allow("10.1.2.3", tt.header)
+			if ok != tt.want {
+				t.Errorf("allow with header %q = %v, want %v", tt.header, ok, tt.want)
+			}
+		})
+	}
+}
+
+// TestIPFilterConfigAuthBypassRequiresConfiguredKey guards against the
+// misconfiguration where AUTH_BYPASS_HEADER is set but AUTH_BYPASS_KEY is
+// left empty: without also requiring AuthKeyValue != "", every request
+// that omits the bypass header would compare "" == "" and bypass the
+// blacklist for all traffic.
+func TestIPFilterConfigAuthBypassRequiresConfiguredKey(t *testing.T) {
+	cfg := newTestFilterConfig(t, FilterAuthBypass, nil, []string{"10.0.0.0/8"})
+	cfg.AuthKeyHeader = "X-Auth-Key"
+	cfg.AuthKeyValue = ""
+
+	ok, rule := cfg.allow("10.1.2.3", "")
+	if ok {
+		t.Errorf("allow with no configured AuthKeyValue and no header = (ok=%v, rule=%q), want blacklist to still apply", ok, rule)
+	}
+}
+
+func TestParseIPOrHost(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"bare IP", "192.0.2.1", "192.0.2.1"},
+		{"IP with port", "192.0.2.1:8080", "192.0.2.1"},
+		{"unparseable", "not-an-ip", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseIPOrHost(tt.in)
+			if got == nil {
+				if tt.want != "" {
+					t.Errorf("parseIPOrHost(%q) = nil, want %q", tt.in, tt.want)
+				}
+				return
+			}
+			if got.String() != tt.want {
+				t.Errorf("parseIPOrHost(%q) = %q, want %q", tt.in, got.String(), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ForwardedMode controls how the outgoing Forwarded header is handled.
+type ForwardedMode string
+
+const (
+	// ForwardedAppend preserves any existing Forwarded header and adds a
+	// new element for this hop (the default, matching common reverse
+	// proxy behavior for X-Forwarded-For).
+	ForwardedAppend ForwardedMode = "append"
+	// ForwardedReplace drops any existing Forwarded header and emits a
+	// single element describing only this hop.
+	ForwardedReplace ForwardedMode = "replace"
+	// ForwardedOff disables Forwarded header handling entirely; only the
+	// legacy X-Forwarded-* headers are touched.
+	ForwardedOff ForwardedMode = "off"
+)
+
+// forwardedElement is one comma-separated element of a Forwarded header,
+// i.e. the data contributed by a single proxy hop.
+type forwardedElement struct {
+	For   string
+	By    string
+	Host  string
+	Proto string
+}
+
+// ForwardedParser parses RFC 7239 Forwarded headers.
+type ForwardedParser struct{}
+
+// Parse splits a Forwarded header value into its hop elements, left to
+// right (the leftmost element is the one closest to the original client).
+// It tolerates quoted values, bracketed IPv6 literals, and obfuscated
+// identifiers such as "_gazonk" or "unknown".
+func (ForwardedParser) Parse(header string) []forwardedElement {
+	var elements []forwardedElement
+	for _, part := range splitTopLevel(header, ',') {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		var el forwardedElement
+		for _, pair := range splitTopLevel(part, ';') {
+			pair = strings.TrimSpace(pair)
+			if pair == "" {
+				continue
+			}
+			kv := strings.SplitN(pair, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			key := strings.ToLower(strings.TrimSpace(kv[0]))
+			val := unquote(strings.TrimSpace(kv[1]))
+			switch key {
+			case "for":
+				el.For = val
+			case "by":
+				el.By = val
+			case "host":
+				el.Host = val
+			case "proto":
+				el.Proto = val
+			}
+		}
+		elements = append(elements, el)
+	}
+	return elements
+}
+
+// ClientFor returns the "for" parameter of the leftmost element, which
+// RFC 7239 defines as the client closest to the origin server's entry
+// point into the proxy chain.
+func (p ForwardedParser) ClientFor(header string) string {
+	elements := p.Parse(header)
+	if len(elements) == 0 {
+		return ""
+	}
+	return stripForPort(elements[0].For)
+}
+
+// splitTopLevel splits s on sep, respecting double-quoted substrings so a
+// comma or semicolon inside a quoted value (e.g. for="[2001:db8::1]:8080")
+// does not split the element.
+func splitTopLevel(s string, sep byte) []string {
+	var parts []string
+	inQuotes := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuotes = !inQuotes
+		case sep:
+			if !inQuotes {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	parts = append(parts, s[start:])
+	return parts
+}
+
+// quoteForwardedFor renders a client identity as an RFC 7239 "for" token,
+// quoting it when required (IPv6 literals must be bracketed, and anything
+// that isn't a bare RFC 7230 token - including a colon, or a ';'/','/'"'
+// an attacker snuck into X-Forwarded-For/X-Real-IP - needs the surrounding
+// quotes the grammar requires).
+func quoteForwardedFor(ident string) string {
+	if ident == "" {
+		return `"unknown"`
+	}
+	if strings.Contains(ident, ":") && !strings.HasPrefix(ident, "[") {
+		ident = "[" + ident + "]"
+	}
+	return quoteForwardedValue(ident)
+}
+
+// quoteForwardedValue renders s as an RFC 7239 token if it already is one,
+// or as a backslash-escaped quoted-string otherwise. Every Forwarded
+// parameter value (for/by/host/proto) must go through this before being
+// concatenated into the header: the fields are sourced from client-
+// controlled input (X-Forwarded-For, X-Real-IP, Host), and an unescaped
+// ';', ',' or '"' in one of them would let a client inject extra
+// parameters or elements that ForwardedParser.ClientFor would then parse
+// back out as if they came from this hop.
+func quoteForwardedValue(s string) string {
+	if s == "" {
+		return `""`
+	}
+	for i := 0; i < len(s); i++ {
+		if !isForwardedTchar(s[i]) {
+			return quoteForwardedString(s)
+		}
+	}
+	return s
+}
+
+// isForwardedTchar reports whether c is a valid RFC 7230 "tchar", the
+// charset RFC 7239 allows in an unquoted Forwarded parameter token.
+func isForwardedTchar(c byte) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	switch c {
+	case '!', '#', '$', '%', '&', '\'', '*', '+', '-', '.', '^', '_', '`', '|', '~':
+		return true
+	}
+	return false
+}
+
+// quoteForwardedString wraps s in a quoted-string, backslash-escaping the
+// two characters ('"' and '\') the grammar requires it for.
+func quoteForwardedString(s string) string {
+	var b strings.Builder
+	b.Grow(len(s) + 2)
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+		s = strings.ReplaceAll(s, `\"`, `"`)
+	}
+	return s
+}
+
+// stripForPort removes an optional ":port" suffix from a for= identity,
+// taking care not to mangle a bracketed IPv6 literal such as
+// "[2001:db8::1]:8080" or an obfuscated token like "_gazonk".
+func stripForPort(ident string) string {
+	if ident == "" {
+		return ident
+	}
+	if strings.HasPrefix(ident, "[") {
+		if end := strings.Index(ident, "]"); end != -1 {
+			return ident[:end+1]
+		}
+		return ident
+	}
+	if host, _, err := net.SplitHostPort(ident); err == nil {
+		return host
+	}
+	return ident
+}
+
+// forwardedConfig holds the FORWARDED_MODE and TRUSTED_PROXIES settings
+// loaded from the environment.
+type forwardedConfig struct {
+	Mode           ForwardedMode
+	TrustedProxies []*net.IPNet
+}
+
+// loadForwardedConfig reads FORWARDED_MODE (default "append") and
+// TRUSTED_PROXIES (a comma-separated list of CIDRs; bare IPs are treated
+// as /32 or /128) from the environment.
+func loadForwardedConfig() forwardedConfig {
+	mode := ForwardedMode(strings.ToLower(strings.TrimSpace(os.Getenv("FORWARDED_MODE"))))
+	switch mode {
+	case ForwardedAppend, ForwardedReplace, ForwardedOff:
+	default:
+		mode = ForwardedAppend
+	}
+
+	cfg := forwardedConfig{Mode: mode}
+	raw := os.Getenv("TRUSTED_PROXIES")
+	if raw == "" {
+		return cfg
+	}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 32
+				if ip.To4() == nil {
+					bits = 128
+				}
+				entry = entry + "/" + strconv.Itoa(bits)
+			}
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			continue
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, ipNet)
+	}
+	return cfg
+}
+
+// trusted reports whether remoteAddr (as found on http.Request.RemoteAddr,
+// i.e. possibly including a port) belongs to a configured trusted proxy.
+// With no TRUSTED_PROXIES configured, every hop is trusted, preserving the
+// previous behavior of always honoring the forwarding headers.
+func (c forwardedConfig) trusted(remoteAddr string) bool {
+	if len(c.TrustedProxies) == 0 {
+		return true
+	}
+	host := remoteAddr
+	if h, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range c.TrustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestForwardedParserParse(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   []forwardedElement
+	}{
+		{
+			name:   "basic",
+			header: `for=192.0.2.60;proto=http;by=203.0.113.43`,
+			want: []forwardedElement{
+				{For: "192.0.2.60", By: "203.0.113.43", Proto: "http"},
+			},
+		},
+		{
+			name:   "quoted value",
+			header: `for="192.0.2.60:48170"`,
+			want: []forwardedElement{
+				{For: "192.0.2.60:48170"},
+			},
+		},
+		{
+			name:   "bracketed IPv6 literal",
+			header: `for="[2001:db8:cafe::17]:4711"`,
+			want: []forwardedElement{
+				{For: "[2001:db8:cafe::17]:4711"},
+			},
+		},
+		{
+			name:   "obfuscated identifiers",
+			header: `for=_gazonk;by=unknown`,
+			want: []forwardedElement{
+				{For: "_gazonk", By: "unknown"},
+			},
+		},
+		{
+			name:   "comma-separated chain",
+			header: `for=192.0.2.60, for=198.51.100.17`,
+			want: []forwardedElement{
+				{For: "192.0.2.60"},
+				{For: "198.51.100.17"},
+			},
+		},
+		{
+			name:   "empty",
+			header: "",
+			want:   nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := (ForwardedParser{}).Parse(tt.header)
+			if len(got) != len(tt.want) {
+				t.Fatalf("Parse(%q) = %+v, want %+v", tt.header, got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("Parse(%q)[%d] = %+v, want %+v", tt.header, i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestForwardedParserClientFor(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+	}{
+		{"plain IP", `for=192.0.2.60;proto=http`, "192.0.2.60"},
+		{"quoted with port", `for="192.0.2.60:48170"`, "192.0.2.60"},
+		{"bracketed IPv6 with port", `for="[2001:db8:cafe::17]:4711"`, "[2001:db8:cafe::17]"},
+		{"obfuscated identity", `for=_gazonk`, "_gazonk"},
+		{"chain uses leftmost hop", `for=192.0.2.60, for=198.51.100.17;by=203.0.113.43`, "192.0.2.60"},
+		{"empty header", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (ForwardedParser{}).ClientFor(tt.header); got != tt.want {
+				t.Errorf("ClientFor(%q) = %q, want %q", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripForPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		ident string
+		want  string
+	}{
+		{"plain IPv4", "192.0.2.60", "192.0.2.60"},
+		{"IPv4 with port", "192.0.2.60:48170", "192.0.2.60"},
+		{"bracketed IPv6 with port", "[2001:db8::1]:8080", "[2001:db8::1]"},
+		{"bracketed IPv6 without port", "[2001:db8::1]", "[2001:db8::1]"},
+		{"obfuscated identifier", "_gazonk", "_gazonk"},
+		{"unknown token", "unknown", "unknown"},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripForPort(tt.ident); got != tt.want {
+				t.Errorf("stripForPort(%q) = %q, want %q", tt.ident, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoteForwardedFor(t *testing.T) {
+	tests := []struct {
+		name  string
+		ident string
+		want  string
+	}{
+		{"empty becomes unknown", "", `"unknown"`},
+		{"plain IPv4", "192.0.2.60", "192.0.2.60"},
+		{"bare IPv6 gets bracketed and quoted", "2001:db8::1", `"[2001:db8::1]"`},
+		{"already bracketed IPv6 gets quoted", "[2001:db8::1]", `"[2001:db8::1]"`},
+		{"obfuscated identifier", "_gazonk", "_gazonk"},
+		{"embedded semicolon is quoted, not injected", "1.2.3.4;proto=https", `"1.2.3.4;proto=https"`},
+		{"embedded comma is quoted, not injected", "1.2.3.4, 9.9.9.9", `"1.2.3.4, 9.9.9.9"`},
+		{"embedded quote is escaped", `1.2.3.4"`, `"1.2.3.4\""`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteForwardedFor(tt.ident); got != tt.want {
+				t.Errorf("quoteForwardedFor(%q) = %q, want %q", tt.ident, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuoteForwardedValue(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"empty", "", `""`},
+		{"plain host", "example.com", "example.com"},
+		{"host with port is quoted", "example.com:8080", `"example.com:8080"`},
+		{"injected parameter is quoted whole, not split", `example.com;for=9.9.9.9`, `"example.com;for=9.9.9.9"`},
+		{"embedded quote is escaped", `evil"; for=9.9.9.9`, `"evil\"; for=9.9.9.9"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := quoteForwardedValue(tt.in); got != tt.want {
+				t.Errorf("quoteForwardedValue(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestForwardedRoundTripRejectsInjection guards against the class of bug
+// this quoting exists to prevent: a client-controlled for/host/proto value
+// containing Forwarded metacharacters must not let the attacker forge a
+// different for= that ClientFor later reports as this hop's client.
+func TestForwardedRoundTripRejectsInjection(t *testing.T) {
+	hop := "1.2.3.4;proto=https;for=9.9.9.9"
+	host := "victim.example"
+	proto := "http"
+	element := "for=" + quoteForwardedFor(hop) + ";host=" + quoteForwardedValue(host) + ";proto=" + quoteForwardedValue(proto)
+
+	got := (ForwardedParser{}).ClientFor(element)
+	if got != hop {
+		t.Errorf("ClientFor round-tripped to %q, want the untampered hop %q (injection not prevented)", got, hop)
+	}
+}
+
+func TestForwardedConfigTrusted(t *testing.T) {
+	cfgNoProxies := forwardedConfig{}
+	if !cfgNoProxies.trusted("203.0.113.5:1234") {
+		t.Error("with no TRUSTED_PROXIES configured, every hop should be trusted")
+	}
+
+	var cfg forwardedConfig
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.1/32"} {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatalf("ParseCIDR(%q): %v", cidr, err)
+		}
+		cfg.TrustedProxies = append(cfg.TrustedProxies, ipNet)
+	}
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		want       bool
+	}{
+		{"inside trusted CIDR", "10.1.2.3:5555", true},
+		{"exact trusted IP without port", "192.168.1.1:9090", true},
+		{"outside trusted ranges", "8.8.8.8:443", false},
+		{"unparseable remote addr", "not-an-ip", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.trusted(tt.remoteAddr); got != tt.want {
+				t.Errorf("trusted(%q) = %v, want %v", tt.remoteAddr, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,20 +1,29 @@
 package main
 
 import (
+	"bufio"
+	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"mini-proxy/accesslog"
 )
 
-// responseWriter wraps http.ResponseWriter to capture status code
+// responseWriter wraps http.ResponseWriter to capture the status code and
+// response size for the access log.
 type responseWriter struct {
 	http.ResponseWriter
 	statusCode int
+	size       int64
 }
 
 func (rw *responseWriter) WriteHeader(code int) {
@@ -22,37 +31,78 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
-// loggedTransport wraps an http.RoundTripper to log requests and responses
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	n, err := rw.ResponseWriter.Write(b)
+	rw.size += int64(n)
+	return n, err
+}
+
+// Hijack forwards to the embedded ResponseWriter so WebSocket/CONNECT
+// handling (which needs to take over the raw connection) still works
+// through this wrapper.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errNotHijackable
+	}
+	return hijacker.Hijack()
+}
+
+// Flush forwards to the embedded ResponseWriter, if it supports it, so
+// streaming responses aren't buffered indefinitely by this wrapper.
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+var errNotHijackable = fmt.Errorf("underlying ResponseWriter does not support hijacking")
+
+// loggedTransport wraps an http.RoundTripper to time backend requests,
+// recording the upstream latency on the request's requestLogRecord
+// instead of logging directly, so logMiddleware can emit one correlated
+// access log entry per request.
 type loggedTransport struct {
 	http.RoundTripper
 }
 
 func (t *loggedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
-	// Log the request being sent to the backend
-	log.Printf("Backend request: %s %s Host: %s X-Forwarded-For: %s", 
-		req.Method, req.URL.String(), req.Host, req.Header.Get("X-Forwarded-For"))
-	
-	// Execute the request
+	start := time.Now()
 	resp, err := t.RoundTripper.RoundTrip(req)
-	
-	// Log the response
-	if err != nil {
-		log.Printf("Backend error: %v for %s %s", err, req.Method, req.URL.String())
-	} else {
-		log.Printf("Backend response: %s %s -> %s", req.Method, req.URL.String(), resp.Status)
+
+	if rec := requestLogFromContext(req.Context()); rec != nil {
+		rec.UpstreamLatency = time.Since(start)
 	}
-	
+
 	return resp, err
 }
 
-// getRealIP extracts the real IP address from an HTTP request
-func getRealIP(r *http.Request) string {
+// getRealIP extracts the real IP address from an HTTP request. Forwarding
+// headers (X-Real-IP, X-Forwarded-For, Forwarded) are only honored when
+// fwdCfg considers the immediate peer (r.RemoteAddr) a trusted proxy;
+// otherwise they could be spoofed by the client itself.
+func getRealIP(r *http.Request, fwdCfg forwardedConfig) string {
+	if !fwdCfg.trusted(r.RemoteAddr) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return ip
+	}
+
 	// Check X-Real-IP header first (highest priority)
 	xri := r.Header.Get("X-Real-IP")
 	if xri != "" {
 		return xri
 	}
-	
+
+	// Check the standard Forwarded header next
+	if fwd := r.Header.Get("Forwarded"); fwd != "" {
+		if forHost := (ForwardedParser{}).ClientFor(fwd); forHost != "" {
+			return forHost
+		}
+	}
+
 	// Check X-Forwarded-For header
 	xff := r.Header.Get("X-Forwarded-For")
 	if xff != "" {
@@ -62,7 +112,7 @@ func getRealIP(r *http.Request) string {
 			return strings.TrimSpace(ips[0])
 		}
 	}
-	
+
 	// Fall back to RemoteAddr
 	ip, _, err := net.SplitHostPort(r.RemoteAddr)
 	if err != nil {
@@ -71,91 +121,214 @@ func getRealIP(r *http.Request) string {
 	return ip
 }
 
-// main starts the reverse proxy server.
-// It reads the backend URL and port from environment variables.
-// BACKEND_URL is required, PORT defaults to 8080 if not set.
+// loadSingleBackendTable builds a one-pool, one-route RoutingTable from
+// the legacy BACKEND_URL environment variable, so the rest of the proxy
+// can treat "one static backend" as the simplest case of the general
+// multi-backend routing table.
+func loadSingleBackendTable(backendURL string) (*RoutingTable, error) {
+	target, err := url.Parse(backendURL)
+	if err != nil {
+		return nil, err
+	}
+	pool := &Pool{Name: "default", Backends: []*Backend{newBackend(target)}}
+	return &RoutingTable{Pools: []*Pool{pool}, Routes: []*Route{{Pool: pool}}}, nil
+}
+
+// main starts the reverse proxy server. Backends are configured either as
+// a single static upstream via BACKEND_URL, or as a full routing table
+// (pools, load-balancing strategy, health checks) loaded from the JSON
+// file named by BACKENDS; the latter is reloaded on SIGHUP. PORT defaults
+// to 8080 if not set.
 func main() {
-	// Get backend URL from environment variable
-	backendURL := os.Getenv("BACKEND_URL")
-	if backendURL == "" {
-		log.Fatal("BACKEND_URL environment variable is required")
+	// Load Forwarded/X-Forwarded-* handling config (FORWARDED_MODE, TRUSTED_PROXIES)
+	fwdCfg := loadForwardedConfig()
+
+	// Backend transport tuning (BACKEND_H2C, BACKEND_TLS_*, MAX_IDLE_CONNS,
+	// MAX_CONNS_PER_HOST, DIAL_TIMEOUT, RESPONSE_HEADER_TIMEOUT); backends
+	// that don't specify their own transport share this one.
+	transportCfg, err := loadTransportConfigFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid backend transport config: %v", err)
+	}
+	defaultTransport, err := buildTransport(transportCfg)
+	if err != nil {
+		log.Fatalf("Failed to build backend transport: %v", err)
 	}
 
-	// Parse the backend URL
-	target, err := url.Parse(backendURL)
+	backendsPath := os.Getenv("BACKENDS")
+	var tableHolder atomic.Value
+	if backendsPath != "" {
+		table, err := loadRoutingTable(backendsPath, defaultTransport)
+		if err != nil {
+			log.Fatalf("Invalid BACKENDS config %s: %v", backendsPath, err)
+		}
+		table.startHealthChecks()
+		tableHolder.Store(table)
+		log.Printf("Loaded routing config from %s: %d pool(s), %d route(s)", backendsPath, len(table.Pools), len(table.Routes))
+	} else {
+		backendURL := os.Getenv("BACKEND_URL")
+		if backendURL == "" {
+			log.Fatal("either BACKENDS or BACKEND_URL environment variable is required")
+		}
+		table, err := loadSingleBackendTable(backendURL)
+		if err != nil {
+			log.Fatalf("Invalid BACKEND_URL: %v", err)
+		}
+		tableHolder.Store(table)
+		log.Printf("Using single backend %s (set BACKENDS for multi-backend routing)", backendURL)
+	}
+
+	// Structured access log (LOG_FORMAT, LOG_FILE/LOG_MAX_MB/LOG_MAX_BACKUPS, LOG_SAMPLE_RATE)
+	accessLogger, err := accesslog.NewFromEnv()
+	if err != nil {
+		log.Fatalf("Invalid access log config: %v", err)
+	}
+
+	// Load the IP allow/deny filter config (WHITELIST_IPS, BLACKLIST_IPS, FILTER_FILE, ...)
+	filterCfg, err := loadIPFilterConfig()
 	if err != nil {
-		log.Fatalf("Invalid BACKEND_URL: %v", err)
+		log.Fatalf("Invalid IP filter config: %v", err)
 	}
+	var filterHolder atomic.Value
+	filterHolder.Store(filterCfg)
 
-	// Create a reverse proxy
-	proxy := httputil.NewSingleHostReverseProxy(target)
-	
-	// Configure the transport for better performance
-	proxy.Transport = &http.Transport{
-		MaxIdleConns:          100,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   10 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		MaxIdleConnsPerHost:   100,
+	// Load the CONNECT destination allowlist (CONNECT_ALLOWED_DESTINATIONS)
+	connectAllowlist, err := loadConnectAllowlist()
+	if err != nil {
+		log.Fatalf("Invalid CONNECT_ALLOWED_DESTINATIONS: %v", err)
 	}
-	
+
+	// Re-read BACKENDS and FILTER_FILE on SIGHUP, without dropping
+	// in-flight connections.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if backendsPath != "" {
+				newTable, err := loadRoutingTable(backendsPath, defaultTransport)
+				if err != nil {
+					log.Printf("SIGHUP: failed to reload BACKENDS config: %v", err)
+				} else {
+					newTable.startHealthChecks()
+					old := tableHolder.Swap(newTable).(*RoutingTable)
+					old.Close()
+					log.Printf("SIGHUP: reloaded routing config from %s", backendsPath)
+				}
+			}
+			newFilterCfg, err := loadIPFilterConfig()
+			if err != nil {
+				log.Printf("SIGHUP: failed to reload IP filter config: %v", err)
+			} else {
+				filterHolder.Store(newFilterCfg)
+				log.Printf("SIGHUP: reloaded IP filter config")
+			}
+		}
+	}()
+
+	// Create a reverse proxy; Director picks the target per-request from
+	// the matched pool rather than rewriting to one fixed host.
+	proxy := &httputil.ReverseProxy{}
+
+	// Dispatch each request to its backend's own transport (set per the
+	// BACKENDS config) or the shared default built from BACKEND_H2C/
+	// BACKEND_TLS_*/MAX_IDLE_CONNS/etc above.
+	proxy.Transport = &perBackendTransport{Default: defaultTransport}
+
 	// Wrap transport to log backend requests
 	originalTransport := proxy.Transport
 	proxy.Transport = &loggedTransport{originalTransport}
-	
+
 	// Set error handler for the proxy
 	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
 		log.Printf("Proxy error for %s %s: %v", r.Method, r.URL.String(), err)
 		http.Error(w, "Proxy error", http.StatusBadGateway)
 	}
 
-	// Add request logging middleware
+	// Add request logging middleware: assigns/propagates X-Request-ID,
+	// and emits one correlated access log entry per request after the
+	// response completes (route, upstream and latency are filled in by
+	// routingHandler and loggedTransport via the request's requestLogRecord).
 	logMiddleware := func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			// Get real IP prioritizing X-Real-IP header
-			realIP := getRealIP(r)
-			xff := r.Header.Get("X-Forwarded-For")
-			xfh := r.Header.Get("X-Forwarded-Host")
-			xproto := r.Header.Get("X-Forwarded-Proto")
-			xri := r.Header.Get("X-Real-IP")
-			
-			// Log incoming request details with emphasis on X-Real-IP
-			log.Printf("Incoming request: %s %s, Client IP: %s (X-Real-IP: %s, X-Forwarded-For: %s), X-Forwarded-Host: %s, X-Forwarded-Proto: %s", 
-				r.Method, r.URL.Path, realIP, xri, xff, xfh, xproto)
-			
-			// Wrap ResponseWriter to capture status code
+			requestID := r.Header.Get("X-Request-ID")
+			if requestID == "" {
+				requestID = accesslog.NewRequestID(time.Now().UnixMilli())
+				r.Header.Set("X-Request-ID", requestID)
+			}
+
+			ctx, rec := withRequestLog(r.Context())
+			rec.RequestID = requestID
+			r = r.WithContext(ctx)
+
+			start := time.Now()
 			wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
 			next.ServeHTTP(wrapped, r)
-			
-			// Log response details
-			log.Printf("Response: %s %s -> %d", r.Method, r.URL.Path, wrapped.statusCode)
+
+			accessLogger.Log(accesslog.Entry{
+				Time:            start,
+				Method:          r.Method,
+				Path:            r.URL.Path,
+				RealIP:          getRealIP(r, fwdCfg),
+				Upstream:        rec.Upstream,
+				UpstreamLatency: rec.UpstreamLatency,
+				ResponseSize:    wrapped.size,
+				Status:          wrapped.statusCode,
+				RequestID:       requestID,
+				UserAgent:       r.UserAgent(),
+				Route:           rec.Route,
+			})
 		})
 	}
-	
-	// Customize the Director to handle X-Forwarded-* headers properly
-	originalDirector := proxy.Director
+
+	// Director picks the target per-request from the backend stashed in
+	// the request context by the handler below (selected from the
+	// matched route's pool), then applies the same header rewriting the
+	// single-backend proxy always has.
 	proxy.Director = func(req *http.Request) {
-		originalDirector(req)
-		
-		// Remove headers that shouldn't be forwarded to the backend
-		req.Header.Del("Connection")
-		req.Header.Del("Upgrade")
+		backend := backendFromContext(req.Context())
+		target := backend.URL
+
+		// Rewrite scheme/host/path/query onto the chosen backend, the same
+		// way httputil.NewSingleHostReverseProxy's internal director does.
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
+		if target.RawQuery == "" || req.URL.RawQuery == "" {
+			req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
+		} else {
+			req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
+		}
+
+		// Remove headers that shouldn't be forwarded to the backend, but
+		// preserve Connection/Upgrade on an upgrade request (e.g.
+		// WebSocket) - stripping them here broke upgrades, since the
+		// backend needs to see the client's intent to upgrade.
+		if !isWebsocketUpgrade(req) {
+			req.Header.Del("Connection")
+			req.Header.Del("Upgrade")
+		}
 		req.Header.Del("Transfer-Encoding")
-		
+
 		// Save the original host before modifying it
 		originalHost := req.Host
-		
+
 		// Set the Host header to the target host so the backend knows which site to serve
 		req.Host = target.Host
-		
-		// Handle X-Forwarded-For - use X-Real-IP if available, otherwise use existing XFF or client IP
+
+		// Handle X-Forwarded-For - use X-Real-IP if available, otherwise use existing XFF or client IP.
+		// hopIP tracks just this hop's immediate peer (as opposed to the
+		// X-Forwarded-For header, which accumulates the whole chain) for
+		// the Forwarded "for=" element built below.
 		xri := req.Header.Get("X-Real-IP")
+		var hopIP string
 		if xri != "" {
 			// If X-Real-IP exists, use it as the X-Forwarded-For value
+			hopIP = xri
 			req.Header.Set("X-Forwarded-For", xri)
 		} else {
 			// If no X-Real-IP, use the standard approach
 			if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+				hopIP = clientIP
 				// Check if X-Forwarded-For already exists and append to it
 				if prior, ok := req.Header["X-Forwarded-For"]; ok {
 					clientIP = strings.Join(prior, ", ") + ", " + clientIP
@@ -184,10 +357,23 @@ func main() {
 		if _, ok := req.Header["X-Forwarded-Host"]; !ok {
 			req.Header.Set("X-Forwarded-Host", originalHost)
 		}
-		
-		// Log the modified request details before forwarding
-		log.Printf("Forwarding request: %s %s to %s with Host: %s, X-Forwarded-For: %s", 
-			req.Method, req.URL.Path, target.String(), req.Host, req.Header.Get("X-Forwarded-For"))
+
+		// Build/emit the RFC 7239 Forwarded header alongside the legacy
+		// X-Forwarded-* set, per FORWARDED_MODE.
+		if fwdCfg.Mode != ForwardedOff {
+			proto := req.Header.Get("X-Forwarded-Proto")
+			element := "for=" + quoteForwardedFor(hopIP) + ";host=" + quoteForwardedValue(originalHost) + ";proto=" + quoteForwardedValue(proto)
+			switch fwdCfg.Mode {
+			case ForwardedReplace:
+				req.Header.Set("Forwarded", element)
+			case ForwardedAppend:
+				if prior := req.Header.Get("Forwarded"); prior != "" {
+					req.Header.Set("Forwarded", prior+", "+element)
+				} else {
+					req.Header.Set("Forwarded", element)
+				}
+			}
+		}
 	}
 
 	// Get port from environment variable, default to 8080
@@ -196,15 +382,69 @@ func main() {
 		port = "8080"
 	}
 
-	// Add timeout middleware
-	var handler http.Handler = proxy
-	handler = logMiddleware(handler)
-	handler = http.TimeoutHandler(handler, 30*time.Second, "Proxy timeout")
+	// Match the request against the current routing table, pick a backend
+	// from its pool, and hand off to the reverse proxy; the Director reads
+	// the chosen backend back out of the request context.
+	routingHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// HTTP CONNECT tunnels straight to the requested host:port; it
+		// doesn't go through the routing table since the target is the
+		// tunnel's destination, not an upstream pool.
+		if r.Method == http.MethodConnect {
+			handleConnect(w, r, connectAllowlist)
+			return
+		}
+
+		table := tableHolder.Load().(*RoutingTable)
+		route := table.Match(r)
+		if route == nil {
+			log.Printf("No route matched for %s %s", r.Method, r.URL.Path)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		backend := route.Pool.Next(getRealIP(r, fwdCfg))
+		if backend == nil {
+			log.Printf("No healthy backend in pool %s for %s %s", route.Pool.Name, r.Method, r.URL.Path)
+			http.Error(w, "Bad Gateway", http.StatusBadGateway)
+			return
+		}
+		if rec := requestLogFromContext(r.Context()); rec != nil {
+			rec.Route = route.Pattern()
+			rec.Upstream = backend.URL.Host
+		}
+
+		if isWebsocketUpgrade(r) {
+			handleWebsocket(w, r, backend)
+			return
+		}
+
+		backend.activeConns.Add(1)
+		defer backend.activeConns.Add(-1)
+		proxy.ServeHTTP(w, r.WithContext(withBackend(r.Context(), backend)))
+	})
+
+	// Add IP filtering and request logging middleware.
+	var base http.Handler = routingHandler
+	base = ipFilterMiddleware(base, &filterHolder, fwdCfg)
+	base = logMiddleware(base)
+
+	// http.TimeoutHandler's ResponseWriter doesn't implement http.Hijacker,
+	// which would break WebSocket upgrades and CONNECT tunnels regardless
+	// of responseWriter's own Hijack passthrough above - so those requests
+	// bypass the timeout wrapper entirely and run on the raw chain instead.
+	withTimeout := http.TimeoutHandler(base, 30*time.Second, "Proxy timeout")
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || isWebsocketUpgrade(r) {
+			base.ServeHTTP(w, r)
+			return
+		}
+		withTimeout.ServeHTTP(w, r)
+	})
+
+	maybeStartMetricsServer()
 
 	// Start the server
-	log.Printf("Starting proxy server on port %s, forwarding to %s", port, backendURL)
-	err = http.ListenAndServe(":"+port, handler)
-	if err != nil {
+	log.Printf("Starting proxy server on port %s", port)
+	if err := http.ListenAndServe(":"+port, handler); err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
 }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+)
+
+// filterMetricsSnapshot is the allowed/denied count for one matched rule.
+type filterMetricsSnapshot struct {
+	Allowed uint64 `json:"allowed"`
+	Denied  uint64 `json:"denied"`
+}
+
+// snapshot renders the current allowed/denied-per-rule counters.
+func (m *filterMetrics) snapshot() map[string]filterMetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := make(map[string]filterMetricsSnapshot, len(m.allowed)+len(m.denied))
+	for rule, counter := range m.allowed {
+		entry := out[rule]
+		entry.Allowed = counter.Load()
+		out[rule] = entry
+	}
+	for rule, counter := range m.denied {
+		entry := out[rule]
+		entry.Denied = counter.Load()
+		out[rule] = entry
+	}
+	return out
+}
+
+// tunnelMetricsSnapshot is the in-flight tunnel counts at a point in time.
+type tunnelMetricsSnapshot struct {
+	ActiveWebsocket int64 `json:"active_websocket"`
+	ActiveConnect   int64 `json:"active_connect"`
+}
+
+// snapshot renders the current in-flight tunnel counters.
+func (m *tunnelMetrics) snapshot() tunnelMetricsSnapshot {
+	return tunnelMetricsSnapshot{
+		ActiveWebsocket: m.activeWebsocket.Load(),
+		ActiveConnect:   m.activeConnect.Load(),
+	}
+}
+
+// metricsHandler serves the IP filter's per-rule counters and the
+// WebSocket/CONNECT tunnel counts as JSON, for operators that want to see
+// which rules are firing and how much tunneled traffic is in flight.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(struct {
+		IPFilter map[string]filterMetricsSnapshot `json:"ip_filter"`
+		Tunnels  tunnelMetricsSnapshot            `json:"tunnels"`
+	}{
+		IPFilter: defaultFilterMetrics.snapshot(),
+		Tunnels:  defaultTunnelMetrics.snapshot(),
+	})
+}
+
+// maybeStartMetricsServer starts a dedicated metrics listener on
+// METRICS_ADDR (e.g. ":9090"), serving /metrics, if that env var is set.
+// It runs on its own address rather than sharing a path on the proxy
+// itself so it can never collide with a configured route.
+func maybeStartMetricsServer() {
+	addr := os.Getenv("METRICS_ADDR")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", metricsHandler)
+	go func() {
+		log.Printf("Metrics server listening on %s (/metrics)", addr)
+		if err := http.ListenAndServe(addr, mux); err != nil {
+			log.Printf("Metrics server stopped: %v", err)
+		}
+	}()
+}
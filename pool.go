@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"hash/fnv"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Backend is a single upstream server that can serve requests for a Pool.
+type Backend struct {
+	URL *url.URL
+	// Transport is this backend's own http.RoundTripper, letting
+	// different backends use different TLS trust roots, client certs, or
+	// h2c vs. HTTPS+ALPN. Nil means "use the proxy's default transport".
+	Transport http.RoundTripper
+
+	healthy     atomic.Bool
+	activeConns atomic.Int64
+	// failures/successes track consecutive health-check results since the
+	// last state flip, compared against the pool's thresholds.
+	failures  atomic.Int32
+	successes atomic.Int32
+}
+
+// newBackend creates a Backend that starts out healthy, using the
+// proxy's default transport; the first health check confirms or corrects
+// the healthy assumption.
+func newBackend(target *url.URL) *Backend {
+	b := &Backend{URL: target}
+	b.healthy.Store(true)
+	return b
+}
+
+// Healthy reports whether this backend is currently in rotation.
+func (b *Backend) Healthy() bool {
+	return b.healthy.Load()
+}
+
+// HealthCheckConfig controls active health checking for a Pool.
+type HealthCheckConfig struct {
+	Path               string        `json:"path"`
+	Interval           time.Duration `json:"-"`
+	IntervalMS         int           `json:"interval_ms"`
+	Timeout            time.Duration `json:"-"`
+	TimeoutMS          int           `json:"timeout_ms"`
+	UnhealthyThreshold int           `json:"unhealthy_threshold"`
+	HealthyThreshold   int           `json:"healthy_threshold"`
+}
+
+func (c *HealthCheckConfig) applyDefaults() {
+	if c.Path == "" {
+		c.Path = "/"
+	}
+	if c.IntervalMS <= 0 {
+		c.IntervalMS = 10000
+	}
+	if c.TimeoutMS <= 0 {
+		c.TimeoutMS = 2000
+	}
+	if c.UnhealthyThreshold <= 0 {
+		c.UnhealthyThreshold = 3
+	}
+	if c.HealthyThreshold <= 0 {
+		c.HealthyThreshold = 2
+	}
+	c.Interval = time.Duration(c.IntervalMS) * time.Millisecond
+	c.Timeout = time.Duration(c.TimeoutMS) * time.Millisecond
+}
+
+// Pool is a named group of interchangeable backends reachable through one
+// load-balancing strategy.
+type Pool struct {
+	Name        string
+	Strategy    string // "round_robin" (default), "least_conn", or "ip_hash"
+	Backends    []*Backend
+	HealthCheck HealthCheckConfig
+
+	rrCounter atomic.Uint64
+}
+
+// Next picks a backend for a request from clientIP according to the pool's
+// load-balancing strategy, skipping backends currently marked unhealthy.
+// It returns nil if every backend in the pool is unhealthy.
+func (p *Pool) Next(clientIP string) *Backend {
+	healthy := make([]*Backend, 0, len(p.Backends))
+	for _, b := range p.Backends {
+		if b.Healthy() {
+			healthy = append(healthy, b)
+		}
+	}
+	if len(healthy) == 0 {
+		return nil
+	}
+
+	switch p.Strategy {
+	case "least_conn":
+		best := healthy[0]
+		for _, b := range healthy[1:] {
+			if b.activeConns.Load() < best.activeConns.Load() {
+				best = b
+			}
+		}
+		return best
+	case "ip_hash":
+		h := fnv.New32a()
+		h.Write([]byte(clientIP))
+		return healthy[int(h.Sum32())%len(healthy)]
+	default: // "round_robin"
+		n := p.rrCounter.Add(1)
+		return healthy[int(n-1)%len(healthy)]
+	}
+}
+
+// runHealthChecks periodically probes every backend in the pool until
+// stop is closed, flipping Healthy() once a backend crosses the
+// configured unhealthy/healthy consecutive-result threshold.
+func (p *Pool) runHealthChecks(stop <-chan struct{}) {
+	if p.HealthCheck.Interval <= 0 {
+		return
+	}
+	client := &http.Client{Timeout: p.HealthCheck.Timeout}
+	ticker := time.NewTicker(p.HealthCheck.Interval)
+	defer ticker.Stop()
+
+	check := func(b *Backend) {
+		checkURL := *b.URL
+		checkURL.Path = singleJoiningSlash(b.URL.Path, p.HealthCheck.Path)
+		resp, err := client.Get(checkURL.String())
+		ok := err == nil && resp.StatusCode < 500
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if ok {
+			b.failures.Store(0)
+			if b.successes.Add(1) >= int32(p.HealthCheck.HealthyThreshold) && !b.Healthy() {
+				b.healthy.Store(true)
+				log.Printf("Health check: backend %s is healthy again (pool %s)", b.URL, p.Name)
+			}
+		} else {
+			b.successes.Store(0)
+			if b.failures.Add(1) >= int32(p.HealthCheck.UnhealthyThreshold) && b.Healthy() {
+				b.healthy.Store(false)
+				log.Printf("Health check: backend %s marked unhealthy (pool %s): %v", b.URL, p.Name, err)
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, b := range p.Backends {
+				go check(b)
+			}
+		}
+	}
+}
+
+// Route matches incoming requests by host, path prefix and method to a
+// Pool of upstream backends. An empty Host or empty Methods matches any
+// value for that field.
+type Route struct {
+	Host       string
+	PathPrefix string
+	Methods    []string
+	Pool       *Pool
+}
+
+// Pattern renders a short human-readable description of the route rule,
+// for access log correlation (e.g. "api.example.com/v1 -> api-pool").
+func (rt *Route) Pattern() string {
+	host := rt.Host
+	if host == "" {
+		host = "*"
+	}
+	prefix := rt.PathPrefix
+	if prefix == "" {
+		prefix = "/"
+	}
+	poolName := ""
+	if rt.Pool != nil {
+		poolName = rt.Pool.Name
+	}
+	return host + prefix + " -> " + poolName
+}
+
+func (rt *Route) matches(r *http.Request) bool {
+	if rt.Host != "" && rt.Host != r.Host {
+		return false
+	}
+	if rt.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, rt.PathPrefix) {
+		return false
+	}
+	if len(rt.Methods) > 0 {
+		found := false
+		for _, m := range rt.Methods {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// RoutingTable is the full set of configured routes, matched in order;
+// the first match wins.
+type RoutingTable struct {
+	Routes []*Route
+	Pools  []*Pool
+	stop   chan struct{}
+}
+
+// Match returns the first Route whose rule matches r, or nil if none do.
+func (t *RoutingTable) Match(r *http.Request) *Route {
+	for _, route := range t.Routes {
+		if route.matches(r) {
+			return route
+		}
+	}
+	return nil
+}
+
+// startHealthChecks launches one health-check goroutine per pool.
+func (t *RoutingTable) startHealthChecks() {
+	t.stop = make(chan struct{})
+	for _, p := range t.Pools {
+		go p.runHealthChecks(t.stop)
+	}
+}
+
+// Close stops all health-check goroutines for this table.
+func (t *RoutingTable) Close() {
+	if t.stop != nil {
+		close(t.stop)
+	}
+}
+
+// backendConfig is one entry of a pool's "backends" list. It can be given
+// as a bare URL string, or as an object when a backend needs its own
+// transport tuning (e.g. a different TLS trust root than the rest of the
+// pool); backendConfig.UnmarshalJSON accepts either form.
+type backendConfig struct {
+	URL       string
+	Transport *TransportConfig // nil unless the entry overrides the default transport
+}
+
+func (b *backendConfig) UnmarshalJSON(data []byte) error {
+	var plain string
+	if err := json.Unmarshal(data, &plain); err == nil {
+		b.URL = plain
+		return nil
+	}
+
+	var obj struct {
+		URL                   string `json:"url"`
+		H2C                   bool   `json:"h2c"`
+		TLSInsecureSkipVerify bool   `json:"tls_insecure"`
+		TLSCAFile             string `json:"tls_ca_file"`
+		TLSClientCertFile     string `json:"tls_client_cert"`
+		TLSClientKeyFile      string `json:"tls_client_key"`
+	}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return err
+	}
+	b.URL = obj.URL
+	b.Transport = &TransportConfig{
+		H2C:                   obj.H2C,
+		TLSInsecureSkipVerify: obj.TLSInsecureSkipVerify,
+		TLSCAFile:             obj.TLSCAFile,
+		TLSClientCertFile:     obj.TLSClientCertFile,
+		TLSClientKeyFile:      obj.TLSClientKeyFile,
+	}
+	return nil
+}
+
+// backendsFileConfig is the on-disk shape read from BACKENDS (a JSON
+// file path): named pools of backend URLs, plus routing rules that map
+// requests onto those pools.
+type backendsFileConfig struct {
+	Pools []struct {
+		Name        string            `json:"name"`
+		Strategy    string            `json:"strategy"`
+		Backends    []backendConfig   `json:"backends"`
+		HealthCheck HealthCheckConfig `json:"health_check"`
+	} `json:"pools"`
+	Routes []struct {
+		Host       string   `json:"host"`
+		PathPrefix string   `json:"path_prefix"`
+		Methods    []string `json:"methods"`
+		Pool       string   `json:"pool"`
+	} `json:"routes"`
+}
+
+// loadRoutingTable reads and validates the BACKENDS config file at path.
+// defaultTransport is used for any backend entry that doesn't specify its
+// own transport overrides.
+func loadRoutingTable(path string, defaultTransport http.RoundTripper) (*RoutingTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg backendsFileConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+
+	pools := make(map[string]*Pool, len(cfg.Pools))
+	table := &RoutingTable{}
+	for _, pc := range cfg.Pools {
+		pool := &Pool{Name: pc.Name, Strategy: pc.Strategy, HealthCheck: pc.HealthCheck}
+		pool.HealthCheck.applyDefaults()
+		for _, bc := range pc.Backends {
+			target, err := url.Parse(bc.URL)
+			if err != nil {
+				return nil, err
+			}
+			backend := newBackend(target)
+			if bc.Transport != nil {
+				backend.Transport, err = buildTransport(*bc.Transport)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				backend.Transport = defaultTransport
+			}
+			pool.Backends = append(pool.Backends, backend)
+		}
+		pools[pc.Name] = pool
+		table.Pools = append(table.Pools, pool)
+	}
+
+	for _, rc := range cfg.Routes {
+		pool, ok := pools[rc.Pool]
+		if !ok {
+			return nil, &poolNotFoundError{rc.Pool}
+		}
+		table.Routes = append(table.Routes, &Route{
+			Host:       rc.Host,
+			PathPrefix: rc.PathPrefix,
+			Methods:    rc.Methods,
+			Pool:       pool,
+		})
+	}
+	return table, nil
+}
+
+type poolNotFoundError struct{ name string }
+
+func (e *poolNotFoundError) Error() string {
+	return "backends config: route references unknown pool " + e.name
+}
+
+// singleJoiningSlash mirrors the helper httputil.NewSingleHostReverseProxy
+// uses internally to join a backend's base path with the request path
+// without doubling or dropping the separating slash.
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
+
+// backendCtxKey is the context key used to thread the selected Backend
+// from the Director through to loggedTransport so access logs can record
+// which upstream actually served a request.
+type backendCtxKey struct{}
+
+func withBackend(ctx context.Context, b *Backend) context.Context {
+	return context.WithValue(ctx, backendCtxKey{}, b)
+}
+
+func backendFromContext(ctx context.Context) *Backend {
+	b, _ := ctx.Value(backendCtxKey{}).(*Backend)
+	return b
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// requestLogRecord accumulates the fields the Director and loggedTransport
+// learn about a request as it's proxied, so logMiddleware can emit one
+// correlated access log entry after the response completes instead of
+// several separate, uncorrelated log lines.
+type requestLogRecord struct {
+	RequestID       string
+	Route           string
+	Upstream        string
+	UpstreamLatency time.Duration
+}
+
+type reqLogCtxKey struct{}
+
+// withRequestLog attaches a fresh requestLogRecord to ctx and returns both
+// the new context and the record, so the caller can keep writing to it.
+func withRequestLog(ctx context.Context) (context.Context, *requestLogRecord) {
+	rec := &requestLogRecord{}
+	return context.WithValue(ctx, reqLogCtxKey{}, rec), rec
+}
+
+func requestLogFromContext(ctx context.Context) *requestLogRecord {
+	rec, _ := ctx.Value(reqLogCtxKey{}).(*requestLogRecord)
+	return rec
+}
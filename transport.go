@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// TransportConfig controls how the proxy dials and speaks to a backend:
+// plain HTTP/1.1, TLS (optionally with client certs and a custom trust
+// root), or cleartext HTTP/2 (h2c). Backends built without an explicit
+// override share the config loaded from the environment.
+type TransportConfig struct {
+	H2C                   bool
+	TLSInsecureSkipVerify bool
+	TLSCAFile             string
+	TLSClientCertFile     string
+	TLSClientKeyFile      string
+	MaxIdleConns          int
+	MaxConnsPerHost       int
+	DialTimeout           time.Duration
+	ResponseHeaderTimeout time.Duration
+}
+
+// loadTransportConfigFromEnv reads BACKEND_H2C, BACKEND_TLS_INSECURE,
+// BACKEND_TLS_CA_FILE, BACKEND_TLS_CLIENT_CERT/KEY, MAX_IDLE_CONNS,
+// MAX_CONNS_PER_HOST, DIAL_TIMEOUT and RESPONSE_HEADER_TIMEOUT (both in
+// seconds) to build the default backend transport configuration.
+func loadTransportConfigFromEnv() (TransportConfig, error) {
+	cfg := TransportConfig{
+		H2C:                   os.Getenv("BACKEND_H2C") == "true",
+		TLSInsecureSkipVerify: os.Getenv("BACKEND_TLS_INSECURE") == "true",
+		TLSCAFile:             os.Getenv("BACKEND_TLS_CA_FILE"),
+		TLSClientCertFile:     os.Getenv("BACKEND_TLS_CLIENT_CERT"),
+		TLSClientKeyFile:      os.Getenv("BACKEND_TLS_CLIENT_KEY"),
+		MaxIdleConns:          100,
+		MaxConnsPerHost:       100,
+		DialTimeout:           10 * time.Second,
+		ResponseHeaderTimeout: 0,
+	}
+	if v := os.Getenv("MAX_IDLE_CONNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MaxIdleConns = n
+	}
+	if v := os.Getenv("MAX_CONNS_PER_HOST"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.MaxConnsPerHost = n
+	}
+	if v := os.Getenv("DIAL_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.DialTimeout = time.Duration(secs) * time.Second
+	}
+	if v := os.Getenv("RESPONSE_HEADER_TIMEOUT"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.ResponseHeaderTimeout = time.Duration(secs) * time.Second
+	}
+	return cfg, nil
+}
+
+// buildTLSConfig assembles a *tls.Config from cfg's CA file and optional
+// client certificate, for backends reached over HTTPS.
+func buildTLSConfig(cfg TransportConfig) (*tls.Config, error) {
+	tlsCfg := &tls.Config{InsecureSkipVerify: cfg.TLSInsecureSkipVerify}
+
+	if cfg.TLSCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, &invalidCAError{cfg.TLSCAFile}
+		}
+		tlsCfg.RootCAs = pool
+	}
+
+	if cfg.TLSClientCertFile != "" || cfg.TLSClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.TLSClientCertFile, cfg.TLSClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return tlsCfg, nil
+}
+
+type invalidCAError struct{ path string }
+
+func (e *invalidCAError) Error() string {
+	return "no certificates found in CA file " + e.path
+}
+
+// buildTransport returns the http.RoundTripper to use for a backend
+// configured with cfg: an h2c transport (cleartext HTTP/2, per RFC 7540
+// §3.4) when cfg.H2C is set, or a standard *http.Transport tuned from
+// cfg and upgraded via http2.ConfigureTransport so it negotiates HTTP/2
+// over TLS (ALPN "h2") whenever the backend offers it.
+func buildTransport(cfg TransportConfig) (http.RoundTripper, error) {
+	tlsCfg, err := buildTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.H2C {
+		dialer := &net.Dialer{Timeout: cfg.DialTimeout}
+		return &http2.Transport{
+			AllowHTTP: true,
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				// h2c: establish a plain TCP connection; there is no TLS
+				// handshake, just the HTTP/2 client preface over cleartext.
+				return dialer.DialContext(ctx, network, addr)
+			},
+		}, nil
+	}
+
+	transport := &http.Transport{
+		Proxy:                 nil,
+		DialContext:           (&net.Dialer{Timeout: cfg.DialTimeout}).DialContext,
+		TLSClientConfig:       tlsCfg,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConns,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+	}
+	// Prefer ALPN h2 on TLS backends automatically; falls back to
+	// HTTP/1.1 for backends that don't offer it.
+	if err := http2.ConfigureTransport(transport); err != nil {
+		return nil, err
+	}
+	return transport, nil
+}
+
+// perBackendTransport dispatches each request to the http.RoundTripper
+// configured for the backend stashed in its context, falling back to a
+// shared default transport for requests with no per-backend override
+// (the common case: one global BACKEND_H2C/BACKEND_TLS_* config).
+type perBackendTransport struct {
+	Default http.RoundTripper
+}
+
+func (t *perBackendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if backend := backendFromContext(req.Context()); backend != nil && backend.Transport != nil {
+		return backend.Transport.RoundTrip(req)
+	}
+	return t.Default.RoundTrip(req)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"crypto/tls"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// tunnelMetrics counts raw TCP tunnels (WebSocket upgrades and HTTP
+// CONNECT) currently in flight, for operators watching proxy load that
+// the regular request logs don't capture.
+type tunnelMetrics struct {
+	activeWebsocket atomic.Int64
+	activeConnect   atomic.Int64
+}
+
+var defaultTunnelMetrics tunnelMetrics
+
+// tunnelIdleTimeout bounds how long a hijacked tunnel may sit with no
+// data flowing in either direction before it's closed; configurable via
+// TUNNEL_IDLE_TIMEOUT (seconds), defaulting to 5 minutes.
+func tunnelIdleTimeout() time.Duration {
+	if v := os.Getenv("TUNNEL_IDLE_TIMEOUT"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return 5 * time.Minute
+}
+
+// tunnelMaxDuration bounds the total lifetime of a hijacked tunnel,
+// closing it even if bytes are still flowing; unlike tunnelIdleTimeout
+// this catches a slow-trickle connection that never goes idle long
+// enough to trip the per-read deadline. Configurable via
+// TUNNEL_MAX_DURATION (seconds), defaulting to 1 hour.
+func tunnelMaxDuration() time.Duration {
+	if v := os.Getenv("TUNNEL_MAX_DURATION"); v != "" {
+		if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	return time.Hour
+}
+
+// connectAllowlist restricts which hosts an HTTP CONNECT tunnel may dial.
+// Without it, CONNECT turns the proxy into an open TCP relay for any
+// client that clears the IP filter (which only gates on client IP, never
+// on tunnel destination) - letting it reach internal/loopback/metadata
+// addresses the operator never intended to expose.
+type connectAllowlist struct {
+	destinations *cidrSet
+}
+
+// loadConnectAllowlist reads CONNECT_ALLOWED_DESTINATIONS (a comma-
+// separated list of CIDRs; bare IPs are treated as /32 or /128) from the
+// environment. It's loaded once at startup, unlike the IP filter:
+// tunnel destinations aren't something operators need to hot-reload.
+func loadConnectAllowlist() (*connectAllowlist, error) {
+	var dests []string
+	if v := os.Getenv("CONNECT_ALLOWED_DESTINATIONS"); v != "" {
+		dests = strings.Split(v, ",")
+	}
+	set, err := newCIDRSet(dests)
+	if err != nil {
+		return nil, err
+	}
+	return &connectAllowlist{destinations: set}, nil
+}
+
+// allowed reports whether hostport's host resolves to an address in the
+// allowlist. With CONNECT_ALLOWED_DESTINATIONS unset, every destination is
+// allowed, matching forwardedConfig.trusted's "no config = trust
+// everyone" default. Note the resolution here is a separate DNS lookup
+// from the one dialTarget/net.DialTimeout performs for the actual
+// connection, so this doesn't close a DNS-rebinding race - just the
+// open-relay case of an unrestricted allowlist.
+func (a *connectAllowlist) allowed(hostport string) bool {
+	if a == nil || a.destinations.Empty() {
+		return true
+	}
+	host, _, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host = hostport
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		ok, _ := a.destinations.Contains(ip)
+		return ok
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false
+	}
+	for _, ip := range ips {
+		if ok, _ := a.destinations.Contains(ip); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// isWebsocketUpgrade reports whether r is an HTTP/1.1 WebSocket upgrade
+// request per RFC 6455 (an Upgrade: websocket header alongside a
+// Connection header that includes "Upgrade").
+func isWebsocketUpgrade(r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, token := range strings.Split(r.Header.Get("Connection"), ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true
+		}
+	}
+	return false
+}
+
+// dialTarget opens a TCP (or TLS, for https:// backends) connection to
+// target, suitable for handing off to io.Copy after a hijack.
+func dialTarget(target *url.URL) (net.Conn, error) {
+	host := target.Host
+	if target.Scheme == "https" {
+		return tls.Dial("tcp", host, &tls.Config{ServerName: hostOnly(host)})
+	}
+	return net.DialTimeout("tcp", host, 10*time.Second)
+}
+
+// hostOnly strips an optional ":port" suffix for use as a TLS ServerName.
+func hostOnly(hostport string) string {
+	if host, _, err := net.SplitHostPort(hostport); err == nil {
+		return host
+	}
+	return hostport
+}
+
+// handleWebsocket hijacks the client connection, dials the chosen
+// backend, replays the original request line and headers, and then
+// copies bytes bidirectionally until either side closes. This bypasses
+// httputil.ReverseProxy entirely so the raw TCP stream is never buffered
+// or reinterpreted as HTTP once the upgrade handshake is forwarded.
+func handleWebsocket(w http.ResponseWriter, r *http.Request, backend *Backend) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+
+	backendConn, err := dialTarget(backend.URL)
+	if err != nil {
+		log.Printf("WebSocket: failed to dial backend %s: %v", backend.URL.Host, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		backendConn.Close()
+		log.Printf("WebSocket: failed to hijack client connection: %v", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	// Rewrite the request onto the backend the same way the Director
+	// would, then replay the request line and headers as-is.
+	r.URL.Scheme = backend.URL.Scheme
+	r.URL.Host = backend.URL.Host
+	r.Host = backend.URL.Host
+	if err := r.Write(backendConn); err != nil {
+		clientConn.Close()
+		backendConn.Close()
+		log.Printf("WebSocket: failed to replay request to backend %s: %v", backend.URL.Host, err)
+		return
+	}
+	// Any bytes the client already sent beyond the request (pipelined
+	// frames) need to be forwarded too.
+	if clientBuf.Reader.Buffered() > 0 {
+		if _, err := io.CopyN(backendConn, clientBuf.Reader, int64(clientBuf.Reader.Buffered())); err != nil {
+			clientConn.Close()
+			backendConn.Close()
+			return
+		}
+	}
+
+	defaultTunnelMetrics.activeWebsocket.Add(1)
+	log.Printf("WebSocket: tunneling %s <-> %s for %s", r.RemoteAddr, backend.URL.Host, r.URL.Path)
+	pipe(clientConn, backendConn, tunnelIdleTimeout(), tunnelMaxDuration())
+	defaultTunnelMetrics.activeWebsocket.Add(-1)
+}
+
+// handleConnect implements HTTP CONNECT tunneling (RFC 7231 §4.3.6): it
+// dials the requested host:port directly (no routing table lookup, since
+// the target is the tunnel's destination, not an upstream pool) and
+// copies bytes bidirectionally once the tunnel is established. This is
+// how the proxy fronts gRPC-over-h2c and raw TLS pass-through. The
+// destination must clear allowlist before it's dialed - see
+// connectAllowlist for why that check exists.
+func handleConnect(w http.ResponseWriter, r *http.Request, allowlist *connectAllowlist) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "CONNECT not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if !allowlist.allowed(r.Host) {
+		log.Printf("CONNECT: destination %s rejected by allowlist", r.Host)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	targetConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		log.Printf("CONNECT: failed to dial %s: %v", r.Host, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		targetConn.Close()
+		log.Printf("CONNECT: failed to hijack client connection for %s: %v", r.Host, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		targetConn.Close()
+		return
+	}
+
+	defaultTunnelMetrics.activeConnect.Add(1)
+	log.Printf("CONNECT: tunneling %s <-> %s", r.RemoteAddr, r.Host)
+	pipe(clientConn, targetConn, tunnelIdleTimeout(), tunnelMaxDuration())
+	defaultTunnelMetrics.activeConnect.Add(-1)
+}
+
+// pipe copies bytes in both directions between a and b until either side
+// closes, sits idle past idleTimeout, or the tunnel's total lifetime
+// passes maxDuration - the last one bounds a slow-trickle connection that
+// never goes idle long enough to trip the per-read deadline but also
+// never finishes, tying up the goroutines and sockets indefinitely.
+func pipe(a, b net.Conn, idleTimeout, maxDuration time.Duration) {
+	defer a.Close()
+	defer b.Close()
+
+	done := make(chan struct{}, 2)
+	copyDirection := func(dst, src net.Conn) {
+		buf := make([]byte, 32*1024)
+		for {
+			src.SetReadDeadline(time.Now().Add(idleTimeout))
+			n, err := src.Read(buf)
+			if n > 0 {
+				if _, werr := dst.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}
+
+	go copyDirection(b, a)
+	go copyDirection(a, b)
+
+	if maxDuration <= 0 {
+		<-done
+		return
+	}
+	timer := time.NewTimer(maxDuration)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Printf("tunnel: closing after reaching max duration %s", maxDuration)
+	}
+}
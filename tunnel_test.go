@@ -0,0 +1,48 @@
+package main
+
+import "testing"
+
+func TestConnectAllowlistAllowed(t *testing.T) {
+	set, err := newCIDRSet([]string{"203.0.113.0/24"})
+	if err != nil {
+		t.Fatalf("newCIDRSet: %v", err)
+	}
+	allowlist := &connectAllowlist{destinations: set}
+
+	tests := []struct {
+		name string
+		host string
+		want bool
+	}{
+		{"allowed IP with port", "203.0.113.5:443", true},
+		{"allowed IP without port", "203.0.113.5", true},
+		{"disallowed IP", "10.0.0.1:443", false},
+		{"unresolvable host", "this-host-does-not-resolve.invalid:443", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowlist.allowed(tt.host); got != tt.want {
+				t.Errorf("allowed(%q) = %v, want %v", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestConnectAllowlistUnconfiguredAllowsEverything guards the default:
+// with no CONNECT_ALLOWED_DESTINATIONS set, CONNECT must keep working
+// exactly as it did before the allowlist existed.
+func TestConnectAllowlistUnconfiguredAllowsEverything(t *testing.T) {
+	empty, err := newCIDRSet(nil)
+	if err != nil {
+		t.Fatalf("newCIDRSet: %v", err)
+	}
+	allowlist := &connectAllowlist{destinations: empty}
+
+	if !allowlist.allowed("8.8.8.8:443") {
+		t.Error("allowed() with no configured destinations = false, want true")
+	}
+	if !(*connectAllowlist)(nil).allowed("8.8.8.8:443") {
+		t.Error("allowed() on a nil *connectAllowlist = false, want true")
+	}
+}